@@ -2,26 +2,140 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/ses"
-	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sesv2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/golang-jwt/jwt/v5"
+	qrcode "github.com/skip2/go-qrcode"
 )
 
 const (
 	defaultEmailAddress = "notifications.otp@evacrane.com"
+	totpIssuer          = "EvaCrane"
+	totpSecretBytes     = 20
+	totpWindowSeconds   = 30
+	totpWindowSkew      = 1
+	otpMax              = 1000000
+	otpSaltBytes        = 16
+	otpTTLSeconds       = 300
+
+	otpResendIntervalSeconds = 60
+	otpMaxSendsPerHour       = 5
+	otpMaxSendsPerHourByIP   = 20
+	otpRateLimitWindow       = 3600
+	otpMaxVerifyAttempts     = 5
+	totpVerifyLockoutSeconds = 300
+
+	sessionTokenTTL     = 15 * time.Minute
+	sessionTokenIssuer  = "lambda-otp"
+	jwtSigningKeySecret = "lambda-otp/jwt-signing-key"
+)
+
+// dynamoClient, snsClient, sesClient and secretsManagerClient are created
+// once in init() and reused across invocations, avoiding the cold-start cost
+// of re-establishing an AWS session on every call.
+var (
+	dynamoClient         *dynamodb.Client
+	snsClient            *sns.Client
+	sesClient            *sesv2.Client
+	secretsManagerClient *secretsmanager.Client
+
+	signingKey []byte
 )
 
+// baseLogger emits structured JSON log records to CloudWatch Logs so they
+// can be queried with Logs Insights and alarmed on via metric filters.
+var baseLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		baseLogger.Error("failed to load AWS config", "error", err)
+		os.Exit(1)
+	}
+
+	dynamoClient = dynamodb.NewFromConfig(cfg)
+	snsClient = sns.NewFromConfig(cfg)
+	sesClient = sesv2.NewFromConfig(cfg)
+	secretsManagerClient = secretsmanager.NewFromConfig(cfg)
+}
+
+// loggerCtxKey is the context key under which the per-invocation logger
+// (already carrying requestId/route/method fields) is stored.
+type loggerCtxKey struct{}
+
+// withLogger returns a context carrying logger, retrievable via loggerFromContext.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerCtxKey{}, logger)
+}
+
+// loggerFromContext returns the logger stashed by handleRequest, falling
+// back to baseLogger if none is present (e.g. in code not reached via the
+// handler, such as tests).
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerCtxKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return baseLogger
+}
+
+// hashIdentifierForLog returns a short, non-reversible digest of identifier
+// so log records never contain a phone number or email address in the clear.
+func hashIdentifierForLog(identifier string) string {
+	sum := sha256.Sum256([]byte(identifier))
+	return hex.EncodeToString(sum[:8])
+}
+
+// getSigningKey fetches the HS256 session-token signing key from Secrets
+// Manager on first use and caches it for the lifetime of the execution
+// environment.
+func getSigningKey(ctx context.Context) ([]byte, error) {
+	if signingKey != nil {
+		return signingKey, nil
+	}
+
+	out, err := secretsManagerClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(jwtSigningKeySecret),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWT signing key: %w", err)
+	}
+	if out.SecretString == nil {
+		return nil, fmt.Errorf("JWT signing key secret %q has no string value", jwtSigningKeySecret)
+	}
+
+	signingKey = []byte(*out.SecretString)
+	return signingKey, nil
+}
+
 type OTPRequest struct {
 	Identifier string `json:"identifier"`
 	Method     string `json:"method"`
@@ -32,6 +146,75 @@ type OTPVerifyRequest struct {
 	OTP        string `json:"otp"`
 }
 
+type TOTPEnrollRequest struct {
+	Identifier string `json:"identifier"`
+}
+
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QRCode string `json:"qrCode,omitempty"`
+}
+
+type TOTPVerifyRequest struct {
+	Identifier string `json:"identifier"`
+	OTP        string `json:"otp"`
+}
+
+type TOTPUnconfigureRequest struct {
+	Identifier string `json:"identifier"`
+}
+
+type OTPVerifyResponse struct {
+	Token string `json:"token"`
+}
+
+type IntrospectRequest struct {
+	Token string `json:"token"`
+}
+
+type IntrospectResponse struct {
+	Active    bool     `json:"active"`
+	Subject   string   `json:"sub,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	JTI       string   `json:"jti,omitempty"`
+	AMR       []string `json:"amr,omitempty"`
+}
+
+// sessionClaims is the JWT payload minted on successful OTP verification,
+// carrying the RFC 8176 "amr" (Authentication Methods Reference) claim so
+// downstream services know the token was backed by an OTP challenge.
+type sessionClaims struct {
+	AMR []string `json:"amr"`
+	jwt.RegisteredClaims
+}
+
+// otpItem models the items stored in the OTP table, shared by the
+// legacy SMS/email flow (Type=OTP) and the TOTP flow (Type=TOTP).
+type otpItem struct {
+	Identifier  string `dynamodbav:"Identifier"`
+	CreatedAt   int64  `dynamodbav:"CreatedAt"`
+	Type        string `dynamodbav:"Type"`
+	OTPHash     string `dynamodbav:"OTPHash,omitempty"`
+	Salt        string `dynamodbav:"Salt,omitempty"`
+	Attempts    int64  `dynamodbav:"Attempts"`
+	ExpiresAt   int64  `dynamodbav:"ExpiresAt,omitempty"`
+	Secret      string `dynamodbav:"Secret,omitempty"`
+	LockedUntil int64  `dynamodbav:"LockedUntil,omitempty"`
+}
+
+// ipSendItem tracks recent OTP sends per source IP in a small companion
+// table so that SMS/email pumping from a single network can be throttled.
+// WindowID fixes sends to the same hourly bucket to a single item, so the
+// counter can be incremented atomically instead of read-then-written.
+type ipSendItem struct {
+	SourceIP  string `dynamodbav:"SourceIP"`
+	WindowID  int64  `dynamodbav:"WindowID"`
+	Count     int64  `dynamodbav:"Count"`
+	ExpiresAt int64  `dynamodbav:"ExpiresAt"`
+}
+
 func createResponse(statusCode int, body string) events.APIGatewayProxyResponse {
 	return events.APIGatewayProxyResponse{
 		StatusCode: statusCode,
@@ -42,56 +225,395 @@ func createResponse(statusCode int, body string) events.APIGatewayProxyResponse
 	}
 }
 
-func generateOTP() string {
-	return fmt.Sprintf("%06d", rand.Intn(1000000))
+// createThrottledResponse is like createResponse but also sets a
+// Retry-After header so well-behaved clients back off for retryAfterSeconds.
+func createThrottledResponse(statusCode int, body string, retryAfterSeconds int64) events.APIGatewayProxyResponse {
+	resp := createResponse(statusCode, body)
+	resp.Headers["Retry-After"] = strconv.FormatInt(retryAfterSeconds, 10)
+	return resp
+}
+
+// generateOTP returns a cryptographically random 6-digit code, using
+// rejection sampling so the modulo reduction to otpMax doesn't bias toward
+// smaller digits.
+func generateOTP() (string, error) {
+	const maxUint32 uint32 = 1<<32 - 1
+	limit := maxUint32 - (maxUint32 % otpMax)
+
+	buf := make([]byte, 4)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("failed to generate OTP: %w", err)
+		}
+		v := binary.BigEndian.Uint32(buf)
+		if v >= limit {
+			continue
+		}
+		return fmt.Sprintf("%06d", v%otpMax), nil
+	}
+}
+
+// generateSalt returns a random hex-encoded salt for hashing an OTP before
+// it is persisted.
+func generateSalt() (string, error) {
+	buf := make([]byte, otpSaltBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate OTP salt: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashOTP returns the salted HMAC-SHA256 hash of otp, hex-encoded. Only this
+// hash is ever persisted to DynamoDB, never the raw code.
+func hashOTP(otp, salt string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(otp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// generateTOTPSecret returns a random base32-encoded TOTP secret suitable
+// for RFC 6238 enrollment.
+func generateTOTPSecret() (string, error) {
+	raw := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw), nil
+}
+
+// hotp computes an RFC 4226 HOTP code for the given base32 secret and counter.
+func hotp(secret string, counter uint64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode TOTP secret: %w", err)
+	}
+
+	var counterBytes [8]byte
+	binary.BigEndian.PutUint64(counterBytes[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counterBytes[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", truncated%1000000), nil
+}
+
+// verifyTOTPCode checks code against the current window and ±1 window to
+// tolerate clock skew between client and server.
+func verifyTOTPCode(secret, code string) (bool, error) {
+	counter := uint64(time.Now().Unix()) / totpWindowSeconds
+	for i := -totpWindowSkew; i <= totpWindowSkew; i++ {
+		windowCounter := counter
+		if i < 0 {
+			windowCounter -= uint64(-i)
+		} else {
+			windowCounter += uint64(i)
+		}
+		expected, err := hotp(secret, windowCounter)
+		if err != nil {
+			return false, err
+		}
+		if expected == code {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// totpAuthURI builds the otpauth:// URI used by authenticator apps to import
+// the secret.
+func totpAuthURI(identifier, secret string) string {
+	label := url.PathEscape(fmt.Sprintf("%s:%s", totpIssuer, identifier))
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, values.Encode())
+}
+
+// mintSessionToken signs a short-lived JWT proving identifier completed an
+// OTP challenge, for presentation to downstream services.
+func mintSessionToken(ctx context.Context, identifier string) (string, error) {
+	key, err := getSigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	jtiBytes := make([]byte, 16)
+	if _, err := rand.Read(jtiBytes); err != nil {
+		return "", fmt.Errorf("failed to generate token id: %w", err)
+	}
+
+	now := time.Now()
+	claims := sessionClaims{
+		AMR: []string{"otp"},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    sessionTokenIssuer,
+			Subject:   identifier,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(sessionTokenTTL)),
+			ID:        hex.EncodeToString(jtiBytes),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign session token: %w", err)
+	}
+	return signed, nil
+}
+
+// isBrowserFlow reports whether the caller looks like a browser, in which
+// case the session token is also handed back as a cookie.
+func isBrowserFlow(request events.APIGatewayProxyRequest) bool {
+	return strings.Contains(request.Headers["Accept"], "text/html")
+}
+
+// requireVerifiedSession checks that request carries a Bearer session token,
+// minted by mintSessionToken, proving the caller already completed an OTP
+// challenge for identifier. It guards against enrolling a second factor for
+// an identifier the caller does not control.
+func requireVerifiedSession(ctx context.Context, request events.APIGatewayProxyRequest, identifier string) error {
+	const bearerPrefix = "Bearer "
+
+	header := request.Headers["Authorization"]
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return fmt.Errorf("missing bearer session token")
+	}
+	tokenString := strings.TrimPrefix(header, bearerPrefix)
+
+	key, err := getSigningKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	var claims sessionClaims
+	_, err = jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid session token: %w", err)
+	}
+	if claims.Subject != identifier {
+		return fmt.Errorf("session token subject does not match identifier")
+	}
+	return nil
+}
+
+// queryLatestItem returns the most recent OTP table item for identifier
+// with the given Type, or nil if none exists.
+func queryLatestItem(ctx context.Context, identifier, itemType string) (*otpItem, error) {
+	// Type is filtered in Go rather than via FilterExpression: DynamoDB applies
+	// Limit before a FilterExpression runs, so combining the two can silently
+	// drop a valid, slightly-older item of the requested type when a more
+	// recent item of a different type exists for the same identifier (e.g. a
+	// TOTP enrollment after an SMS OTP send).
+	out, err := dynamoClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String("OTP"),
+		KeyConditionExpression: aws.String("Identifier = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: identifier},
+		},
+		ScanIndexForward: aws.Bool(false),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DynamoDB: %w", err)
+	}
+
+	for _, rawItem := range out.Items {
+		var item otpItem
+		if err := attributevalue.UnmarshalMap(rawItem, &item); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal OTP item: %w", err)
+		}
+		if item.Type == itemType {
+			return &item, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// queryRecentOTPSends returns the OTP items sent to identifier since the
+// given unix timestamp, most recent first.
+func queryRecentOTPSends(ctx context.Context, identifier string, since int64) ([]otpItem, error) {
+	out, err := dynamoClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String("OTP"),
+		KeyConditionExpression: aws.String("Identifier = :id AND CreatedAt > :since"),
+		FilterExpression:       aws.String("#t = :type"),
+		ExpressionAttributeNames: map[string]string{
+			"#t": "Type",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":    &types.AttributeValueMemberS{Value: identifier},
+			":since": &types.AttributeValueMemberN{Value: strconv.FormatInt(since, 10)},
+			":type":  &types.AttributeValueMemberS{Value: "OTP"},
+		},
+		ScanIndexForward: aws.Bool(false),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recent OTP sends: %w", err)
+	}
+
+	items := make([]otpItem, 0, len(out.Items))
+	if err := attributevalue.UnmarshalListOfMaps(out.Items, &items); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal OTP items: %w", err)
+	}
+	return items, nil
+}
+
+// checkAndRecordIPSend enforces a per-source-IP hourly send cap using a
+// small companion table keyed by (SourceIP, WindowID). Every request in the
+// same fixed window increments the same item's Count atomically via
+// UpdateItem ADD, so concurrent requests from the same IP cannot race past
+// the cap the way an unsynchronized read-modify-write would. It returns
+// false with the number of seconds the caller should wait if the cap has
+// been reached.
+func checkAndRecordIPSend(ctx context.Context, sourceIP string, now time.Time) (bool, int64, error) {
+	if sourceIP == "" {
+		return true, 0, nil
+	}
+
+	windowID := now.Unix() / otpRateLimitWindow
+	windowStart := windowID * otpRateLimitWindow
+	retryAfter := windowStart + otpRateLimitWindow - now.Unix()
+
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String("OTPSendsByIP"),
+		Key: map[string]types.AttributeValue{
+			"SourceIP": &types.AttributeValueMemberS{Value: sourceIP},
+			"WindowID": &types.AttributeValueMemberN{Value: strconv.FormatInt(windowID, 10)},
+		},
+		UpdateExpression:    aws.String("ADD #count :one SET ExpiresAt = :expires"),
+		ConditionExpression: aws.String("attribute_not_exists(#count) OR #count < :cap"),
+		ExpressionAttributeNames: map[string]string{
+			"#count": "Count",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+			":cap":     &types.AttributeValueMemberN{Value: strconv.FormatInt(otpMaxSendsPerHourByIP, 10)},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(windowStart+otpRateLimitWindow, 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, retryAfter, nil
+	}
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to update IP send counter: %w", err)
+	}
+
+	return true, 0, nil
 }
 
-func sendOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func sendOTP(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	var otpReq OTPRequest
 	err := json.Unmarshal([]byte(request.Body), &otpReq)
 	if err != nil {
 		return createResponse(http.StatusBadRequest, "Invalid request body"), fmt.Errorf("failed to unmarshal request: %w", err)
 	}
 
-	otp := generateOTP()
+	now := time.Now()
 
-	sess := session.Must(session.NewSession())
+	recentSends, err := queryRecentOTPSends(ctx, otpReq.Identifier, now.Add(-otpRateLimitWindow*time.Second).Unix())
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to check send rate"), err
+	}
 
-	// Store OTP in DynamoDB
-	dynamoClient := dynamodb.New(sess)
-	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String("OTP"),
-		Item: map[string]*dynamodb.AttributeValue{
-			"Identifier": {S: aws.String(otpReq.Identifier)},
-			"CreatedAt":  {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
-			"OTP":        {S: aws.String(otp)},
-		},
+	if len(recentSends) > 0 {
+		lastSentAt := recentSends[0].CreatedAt
+		if now.Unix()-lastSentAt < otpResendIntervalSeconds {
+			retryAfter := otpResendIntervalSeconds - (now.Unix() - lastSentAt)
+			loggerFromContext(ctx).Warn("otp send throttled",
+				"event", "otp.send.throttled",
+				"reason", "resend_interval",
+				"identifier", hashIdentifierForLog(otpReq.Identifier),
+				"retry_after", retryAfter,
+			)
+			return createThrottledResponse(http.StatusTooManyRequests, "OTP recently sent, please wait before requesting another", retryAfter), fmt.Errorf("otp resend requested too soon for identifier: %s", otpReq.Identifier)
+		}
+	}
+
+	if int64(len(recentSends)) >= otpMaxSendsPerHour {
+		loggerFromContext(ctx).Warn("otp send throttled",
+			"event", "otp.send.throttled",
+			"reason", "hourly_limit",
+			"identifier", hashIdentifierForLog(otpReq.Identifier),
+			"count", len(recentSends),
+		)
+		return createThrottledResponse(http.StatusTooManyRequests, "Too many OTP requests, please try again later", otpRateLimitWindow), fmt.Errorf("hourly OTP send limit exceeded for identifier: %s", otpReq.Identifier)
+	}
+
+	allowed, retryAfter, err := checkAndRecordIPSend(ctx, request.RequestContext.Identity.SourceIP, now)
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to check send rate"), err
+	}
+	if !allowed {
+		loggerFromContext(ctx).Warn("otp send throttled",
+			"event", "otp.send.throttled",
+			"reason", "ip_hourly_limit",
+			"source_ip", request.RequestContext.Identity.SourceIP,
+		)
+		return createThrottledResponse(http.StatusTooManyRequests, "Too many OTP requests from this network, please try again later", retryAfter), fmt.Errorf("hourly OTP send limit exceeded for source IP: %s", request.RequestContext.Identity.SourceIP)
+	}
+
+	otp, err := generateOTP()
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to generate OTP"), err
+	}
+
+	salt, err := generateSalt()
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to generate OTP"), err
+	}
+
+	// Store only the salted hash of the OTP in DynamoDB, never the raw code.
+	item, err := attributevalue.MarshalMap(otpItem{
+		Identifier: otpReq.Identifier,
+		CreatedAt:  now.Unix(),
+		Type:       "OTP",
+		OTPHash:    hashOTP(otp, salt),
+		Salt:       salt,
+		Attempts:   0,
+		ExpiresAt:  now.Add(otpTTLSeconds * time.Second).Unix(),
 	})
 	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to store OTP"), fmt.Errorf("failed to marshal OTP item: %w", err)
+	}
+
+	if _, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("OTP"),
+		Item:      item,
+	}); err != nil {
 		return createResponse(http.StatusInternalServerError, "Failed to store OTP"), fmt.Errorf("failed to store OTP in DynamoDB: %w", err)
 	}
 
 	switch otpReq.Method {
 	case "sms":
-		snsClient := sns.New(sess)
-		_, err = snsClient.Publish(&sns.PublishInput{
+		_, err = snsClient.Publish(ctx, &sns.PublishInput{
 			Message:     aws.String(fmt.Sprintf("Your OTP is: %s", otp)),
 			PhoneNumber: aws.String(otpReq.Identifier),
 		})
 	case "email":
-		sesClient := ses.New(sess)
-		_, err = sesClient.SendEmail(&ses.SendEmailInput{
-			Source: aws.String(defaultEmailAddress),
-			Destination: &ses.Destination{
-				ToAddresses: []*string{aws.String(otpReq.Identifier)},
+		_, err = sesClient.SendEmail(ctx, &sesv2.SendEmailInput{
+			FromEmailAddress: aws.String(defaultEmailAddress),
+			Destination: &sesv2types.Destination{
+				ToAddresses: []string{otpReq.Identifier},
 			},
-			Message: &ses.Message{
-				Subject: &ses.Content{
-					Data: aws.String("Your OTP"),
-				},
-				Body: &ses.Body{
-					Text: &ses.Content{
-						Data: aws.String(fmt.Sprintf("Your OTP is: %s", otp)),
+			Content: &sesv2types.EmailContent{
+				Simple: &sesv2types.Message{
+					Subject: &sesv2types.Content{
+						Data: aws.String("Your OTP"),
+					},
+					Body: &sesv2types.Body{
+						Text: &sesv2types.Content{
+							Data: aws.String(fmt.Sprintf("Your OTP is: %s", otp)),
+						},
 					},
 				},
 			},
@@ -104,49 +626,349 @@ func sendOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 		return createResponse(http.StatusInternalServerError, "Failed to send OTP"), fmt.Errorf("failed to send OTP: %w", err)
 	}
 
+	loggerFromContext(ctx).Info("otp sent",
+		"event", "otp.sent",
+		"identifier", hashIdentifierForLog(otpReq.Identifier),
+		"method", otpReq.Method,
+	)
+
 	return createResponse(http.StatusOK, "OTP sent successfully"), nil
 }
 
-func verifyOTP(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func verifyOTP(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	var verifyReq OTPVerifyRequest
 	err := json.Unmarshal([]byte(request.Body), &verifyReq)
 	if err != nil {
 		return createResponse(http.StatusBadRequest, "Invalid request body"), fmt.Errorf("failed to unmarshal request: %w", err)
 	}
 
-	sess := session.Must(session.NewSession())
-	dynamoClient := dynamodb.New(sess)
+	item, err := queryLatestItem(ctx, verifyReq.Identifier, "OTP")
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to retrieve OTP"), err
+	}
+	if item == nil {
+		return createResponse(http.StatusBadRequest, "No OTP found"), fmt.Errorf("no OTP found for identifier: %s", verifyReq.Identifier)
+	}
 
-	result, err := dynamoClient.Query(&dynamodb.QueryInput{
-		TableName:              aws.String("OTP"),
-		KeyConditionExpression: aws.String("Identifier = :id"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":id": {S: aws.String(verifyReq.Identifier)},
+	itemKey := map[string]types.AttributeValue{
+		"Identifier": &types.AttributeValueMemberS{Value: verifyReq.Identifier},
+		"CreatedAt":  &types.AttributeValueMemberN{Value: strconv.FormatInt(item.CreatedAt, 10)},
+	}
+
+	if item.Attempts >= otpMaxVerifyAttempts {
+		_, _ = dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: aws.String("OTP"), Key: itemKey})
+		loggerFromContext(ctx).Warn("otp verify locked out",
+			"event", "otp.verify.locked",
+			"identifier", hashIdentifierForLog(verifyReq.Identifier),
+			"attempts", item.Attempts,
+		)
+		return createThrottledResponse(http.StatusTooManyRequests, "Too many failed attempts, request a new OTP", otpResendIntervalSeconds), fmt.Errorf("OTP locked out after %d failed attempts for identifier: %s", item.Attempts, verifyReq.Identifier)
+	}
+
+	if time.Now().Unix()-item.CreatedAt > otpTTLSeconds {
+		loggerFromContext(ctx).Warn("otp verify expired",
+			"event", "otp.verify.expired",
+			"identifier", hashIdentifierForLog(verifyReq.Identifier),
+		)
+		return createResponse(http.StatusBadRequest, "OTP expired"), fmt.Errorf("OTP expired for identifier: %s", verifyReq.Identifier)
+	}
+
+	providedHash := hashOTP(verifyReq.OTP, item.Salt)
+	if subtle.ConstantTimeCompare([]byte(providedHash), []byte(item.OTPHash)) != 1 {
+		newAttempts := item.Attempts + 1
+		_, updateErr := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String("OTP"),
+			Key:              itemKey,
+			UpdateExpression: aws.String("ADD Attempts :inc"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":inc": &types.AttributeValueMemberN{Value: "1"},
+			},
+		})
+		if updateErr != nil {
+			return createResponse(http.StatusInternalServerError, "Failed to record failed attempt"), fmt.Errorf("failed to update attempt counter: %w", updateErr)
+		}
+
+		loggerFromContext(ctx).Warn("otp verify mismatch",
+			"event", "otp.verify.mismatch",
+			"identifier", hashIdentifierForLog(verifyReq.Identifier),
+			"attempts", newAttempts,
+		)
+
+		if newAttempts >= otpMaxVerifyAttempts {
+			_, _ = dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: aws.String("OTP"), Key: itemKey})
+			return createThrottledResponse(http.StatusTooManyRequests, "Too many failed attempts, request a new OTP", otpResendIntervalSeconds), fmt.Errorf("OTP locked out after %d failed attempts for identifier: %s", newAttempts, verifyReq.Identifier)
+		}
+
+		return createResponse(http.StatusBadRequest, "Invalid OTP"), fmt.Errorf("invalid OTP provided for identifier: %s", verifyReq.Identifier)
+	}
+
+	// Mint the session token before consuming the OTP: if Secrets Manager or
+	// JWT signing fails transiently, the caller can retry with the same code
+	// instead of losing it to a DeleteItem that already succeeded.
+	token, err := mintSessionToken(ctx, verifyReq.Identifier)
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to issue session token"), err
+	}
+
+	// Consume the OTP so it cannot be replayed. The condition guards against
+	// a concurrent verify request having already consumed or invalidated it.
+	_, err = dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String("OTP"),
+		Key:                 itemKey,
+		ConditionExpression: aws.String("Attempts = :attempts"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":attempts": &types.AttributeValueMemberN{Value: strconv.FormatInt(item.Attempts, 10)},
 		},
-		ScanIndexForward: aws.Bool(false),
-		Limit:            aws.Int64(1),
 	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		loggerFromContext(ctx).Warn("otp verify replay",
+			"event", "otp.verify.replay",
+			"identifier", hashIdentifierForLog(verifyReq.Identifier),
+		)
+		return createResponse(http.StatusBadRequest, "OTP already used"), fmt.Errorf("OTP already consumed for identifier: %s", verifyReq.Identifier)
+	}
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to finalize OTP verification"), fmt.Errorf("failed to delete consumed OTP: %w", err)
+	}
 
+	body, err := json.Marshal(OTPVerifyResponse{Token: token})
 	if err != nil {
-		return createResponse(http.StatusInternalServerError, "Failed to retrieve OTP"), fmt.Errorf("failed to query DynamoDB: %w", err)
+		return createResponse(http.StatusInternalServerError, "Failed to build response"), fmt.Errorf("failed to marshal verify response: %w", err)
 	}
 
-	if len(result.Items) == 0 {
-		return createResponse(http.StatusBadRequest, "No OTP found"), fmt.Errorf("no OTP found for identifier: %s", verifyReq.Identifier)
+	loggerFromContext(ctx).Info("otp verify success",
+		"event", "otp.verify.success",
+		"identifier", hashIdentifierForLog(verifyReq.Identifier),
+	)
+
+	resp := createResponse(http.StatusOK, string(body))
+	if isBrowserFlow(request) {
+		resp.Headers["Set-Cookie"] = fmt.Sprintf("session=%s; Path=/; HttpOnly; Secure; SameSite=Strict; Max-Age=%d", token, int(sessionTokenTTL.Seconds()))
 	}
 
-	storedOTP := *result.Items[0]["OTP"].S
-	createdAt, _ := strconv.ParseInt(*result.Items[0]["CreatedAt"].N, 10, 64)
+	return resp, nil
+}
 
-	if time.Now().Unix()-createdAt > 300 { // OTP expires after 5 minutes
-		return createResponse(http.StatusBadRequest, "OTP expired"), fmt.Errorf("OTP expired for identifier: %s", verifyReq.Identifier)
+func enrollTOTP(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var enrollReq TOTPEnrollRequest
+	err := json.Unmarshal([]byte(request.Body), &enrollReq)
+	if err != nil {
+		return createResponse(http.StatusBadRequest, "Invalid request body"), fmt.Errorf("failed to unmarshal request: %w", err)
 	}
 
-	if verifyReq.OTP != storedOTP {
-		return createResponse(http.StatusBadRequest, "Invalid OTP"), fmt.Errorf("invalid OTP provided for identifier: %s", verifyReq.Identifier)
+	if err := requireVerifiedSession(ctx, request, enrollReq.Identifier); err != nil {
+		return createResponse(http.StatusUnauthorized, "A verified session for this identifier is required to enroll TOTP"), fmt.Errorf("rejected TOTP enrollment for identifier %s: %w", enrollReq.Identifier, err)
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to generate TOTP secret"), err
+	}
+
+	item, err := attributevalue.MarshalMap(otpItem{
+		Identifier: enrollReq.Identifier,
+		CreatedAt:  time.Now().Unix(),
+		Type:       "TOTP",
+		Secret:     secret,
+	})
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to store TOTP secret"), fmt.Errorf("failed to marshal TOTP item: %w", err)
+	}
+
+	if _, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("OTP"),
+		Item:      item,
+	}); err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to store TOTP secret"), fmt.Errorf("failed to store TOTP secret in DynamoDB: %w", err)
+	}
+
+	uri := totpAuthURI(enrollReq.Identifier, secret)
+
+	resp := TOTPEnrollResponse{
+		Secret: secret,
+		URI:    uri,
+	}
+
+	if png, err := qrcode.Encode(uri, qrcode.Medium, 256); err == nil {
+		resp.QRCode = base64.StdEncoding.EncodeToString(png)
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to build response"), fmt.Errorf("failed to marshal TOTP enrollment response: %w", err)
 	}
 
-	return createResponse(http.StatusOK, "OTP verified successfully"), nil
+	return createResponse(http.StatusOK, string(body)), nil
+}
+
+func verifyTOTP(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var verifyReq TOTPVerifyRequest
+	err := json.Unmarshal([]byte(request.Body), &verifyReq)
+	if err != nil {
+		return createResponse(http.StatusBadRequest, "Invalid request body"), fmt.Errorf("failed to unmarshal request: %w", err)
+	}
+
+	item, err := queryLatestItem(ctx, verifyReq.Identifier, "TOTP")
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to retrieve TOTP secret"), err
+	}
+	if item == nil {
+		return createResponse(http.StatusBadRequest, "No TOTP secret found"), fmt.Errorf("no TOTP secret found for identifier: %s", verifyReq.Identifier)
+	}
+
+	now := time.Now().Unix()
+	if item.LockedUntil > now {
+		loggerFromContext(ctx).Warn("totp verify locked out",
+			"event", "totp.verify.locked",
+			"identifier", hashIdentifierForLog(verifyReq.Identifier),
+			"attempts", item.Attempts,
+		)
+		return createThrottledResponse(http.StatusTooManyRequests, "Too many failed attempts, try again later", item.LockedUntil-now), fmt.Errorf("TOTP locked out until %d for identifier: %s", item.LockedUntil, verifyReq.Identifier)
+	}
+
+	itemKey := map[string]types.AttributeValue{
+		"Identifier": &types.AttributeValueMemberS{Value: verifyReq.Identifier},
+		"CreatedAt":  &types.AttributeValueMemberN{Value: strconv.FormatInt(item.CreatedAt, 10)},
+	}
+
+	ok, err := verifyTOTPCode(item.Secret, verifyReq.OTP)
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to verify TOTP code"), err
+	}
+	if !ok {
+		newAttempts := item.Attempts + 1
+		updateExpression := "ADD Attempts :inc"
+		expressionAttributeValues := map[string]types.AttributeValue{
+			":inc": &types.AttributeValueMemberN{Value: "1"},
+		}
+		if newAttempts >= otpMaxVerifyAttempts {
+			updateExpression = "ADD Attempts :inc SET LockedUntil = :lockedUntil"
+			expressionAttributeValues[":lockedUntil"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(now+totpVerifyLockoutSeconds, 10)}
+		}
+
+		_, updateErr := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String("OTP"),
+			Key:                       itemKey,
+			UpdateExpression:          aws.String(updateExpression),
+			ExpressionAttributeValues: expressionAttributeValues,
+		})
+		if updateErr != nil {
+			return createResponse(http.StatusInternalServerError, "Failed to record failed attempt"), fmt.Errorf("failed to update attempt counter: %w", updateErr)
+		}
+
+		loggerFromContext(ctx).Warn("totp verify mismatch",
+			"event", "totp.verify.mismatch",
+			"identifier", hashIdentifierForLog(verifyReq.Identifier),
+			"attempts", newAttempts,
+		)
+
+		if newAttempts >= otpMaxVerifyAttempts {
+			return createThrottledResponse(http.StatusTooManyRequests, "Too many failed attempts, try again later", totpVerifyLockoutSeconds), fmt.Errorf("TOTP locked out after %d failed attempts for identifier: %s", newAttempts, verifyReq.Identifier)
+		}
+
+		return createResponse(http.StatusBadRequest, "Invalid TOTP code"), fmt.Errorf("invalid TOTP code provided for identifier: %s", verifyReq.Identifier)
+	}
+
+	// Unlike the one-shot legacy OTP, the TOTP secret is long-lived, so a
+	// successful verification resets the counter and any lockout rather than
+	// deleting the item.
+	if item.Attempts != 0 || item.LockedUntil != 0 {
+		_, err = dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String("OTP"),
+			Key:              itemKey,
+			UpdateExpression: aws.String("SET Attempts = :zero REMOVE LockedUntil"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":zero": &types.AttributeValueMemberN{Value: "0"},
+			},
+		})
+		if err != nil {
+			return createResponse(http.StatusInternalServerError, "Failed to verify TOTP code"), fmt.Errorf("failed to reset attempt counter: %w", err)
+		}
+	}
+
+	return createResponse(http.StatusOK, "TOTP verified successfully"), nil
+}
+
+func unconfigureTOTP(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var unconfigureReq TOTPUnconfigureRequest
+	err := json.Unmarshal([]byte(request.Body), &unconfigureReq)
+	if err != nil {
+		return createResponse(http.StatusBadRequest, "Invalid request body"), fmt.Errorf("failed to unmarshal request: %w", err)
+	}
+
+	if err := requireVerifiedSession(ctx, request, unconfigureReq.Identifier); err != nil {
+		return createResponse(http.StatusUnauthorized, "A verified session for this identifier is required to unconfigure TOTP"), fmt.Errorf("rejected TOTP unconfigure for identifier %s: %w", unconfigureReq.Identifier, err)
+	}
+
+	item, err := queryLatestItem(ctx, unconfigureReq.Identifier, "TOTP")
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to remove TOTP secret"), err
+	}
+	if item == nil {
+		return createResponse(http.StatusOK, "TOTP unconfigured successfully"), nil
+	}
+
+	_, err = dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String("OTP"),
+		Key: map[string]types.AttributeValue{
+			"Identifier": &types.AttributeValueMemberS{Value: unconfigureReq.Identifier},
+			"CreatedAt":  &types.AttributeValueMemberN{Value: strconv.FormatInt(item.CreatedAt, 10)},
+		},
+	})
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to remove TOTP secret"), fmt.Errorf("failed to delete TOTP secret from DynamoDB: %w", err)
+	}
+
+	return createResponse(http.StatusOK, "TOTP unconfigured successfully"), nil
+}
+
+func introspect(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var introspectReq IntrospectRequest
+	err := json.Unmarshal([]byte(request.Body), &introspectReq)
+	if err != nil {
+		return createResponse(http.StatusBadRequest, "Invalid request body"), fmt.Errorf("failed to unmarshal request: %w", err)
+	}
+
+	key, err := getSigningKey(ctx)
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to load signing key"), err
+	}
+
+	var claims sessionClaims
+	_, err = jwt.ParseWithClaims(introspectReq.Token, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		body, marshalErr := json.Marshal(IntrospectResponse{Active: false})
+		if marshalErr != nil {
+			return createResponse(http.StatusInternalServerError, "Failed to build response"), marshalErr
+		}
+		return createResponse(http.StatusOK, string(body)), nil
+	}
+
+	resp := IntrospectResponse{
+		Active:  true,
+		Subject: claims.Subject,
+		JTI:     claims.ID,
+		AMR:     claims.AMR,
+	}
+	if claims.IssuedAt != nil {
+		resp.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if claims.ExpiresAt != nil {
+		resp.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return createResponse(http.StatusInternalServerError, "Failed to build response"), fmt.Errorf("failed to marshal introspect response: %w", err)
+	}
+
+	return createResponse(http.StatusOK, string(body)), nil
 }
 
 func main() {
@@ -154,12 +976,40 @@ func main() {
 }
 
 func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	start := time.Now()
+
+	logger := baseLogger.With(
+		"requestId", request.RequestContext.RequestID,
+		"route", request.Resource,
+		"method", request.HTTPMethod,
+	)
+	ctx = withLogger(ctx, logger)
+
+	var resp events.APIGatewayProxyResponse
+	var err error
+
 	switch request.Resource {
 	case "/send-otp":
-		return sendOTP(request)
+		resp, err = sendOTP(ctx, request)
 	case "/verify-otp":
-		return verifyOTP(request)
+		resp, err = verifyOTP(ctx, request)
+	case "/enroll-totp":
+		resp, err = enrollTOTP(ctx, request)
+	case "/verify-totp":
+		resp, err = verifyTOTP(ctx, request)
+	case "/unconfigure-totp":
+		resp, err = unconfigureTOTP(ctx, request)
+	case "/introspect":
+		resp, err = introspect(ctx, request)
 	default:
-		return createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown resource: %s", request.Resource)
+		resp, err = createResponse(http.StatusNotFound, "Not Found"), fmt.Errorf("unknown resource: %s", request.Resource)
 	}
+
+	logger.Info("request completed",
+		"event", "request.completed",
+		"status", resp.StatusCode,
+		"latency_ms", time.Since(start).Milliseconds(),
+	)
+
+	return resp, err
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestGenerateOTPIsSixDigits(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		otp, err := generateOTP()
+		if err != nil {
+			t.Fatalf("generateOTP: %v", err)
+		}
+		if len(otp) != 6 {
+			t.Fatalf("generateOTP() = %q, want 6 digits", otp)
+		}
+		for _, r := range otp {
+			if r < '0' || r > '9' {
+				t.Fatalf("generateOTP() = %q, contains non-digit", otp)
+			}
+		}
+	}
+}
+
+func TestHashOTPIsDeterministicAndSaltDependent(t *testing.T) {
+	a := hashOTP("123456", "saltone")
+	b := hashOTP("123456", "saltone")
+	if a != b {
+		t.Fatalf("hashOTP not deterministic: %q != %q", a, b)
+	}
+
+	c := hashOTP("123456", "salttwo")
+	if a == c {
+		t.Fatalf("hashOTP ignored salt: %q == %q", a, c)
+	}
+}
+
+// RFC 4226 Appendix D test vectors, computed against the 20-byte ASCII
+// secret "12345678901234567890" base32-encoded for our base32-secret API.
+func TestHOTPMatchesRFC4226Vectors(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+
+	for counter, code := range want {
+		got, err := hotp(secret, uint64(counter))
+		if err != nil {
+			t.Fatalf("hotp(%d): %v", counter, err)
+		}
+		if got != code {
+			t.Errorf("hotp(%d) = %q, want %q", counter, got, code)
+		}
+	}
+}
+
+func TestVerifyTOTPCodeToleratesClockSkew(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %v", err)
+	}
+
+	now := time.Now()
+	current, err := hotp(secret, uint64(now.Unix())/totpWindowSeconds)
+	if err != nil {
+		t.Fatalf("hotp: %v", err)
+	}
+	ok, err := verifyTOTPCode(secret, current)
+	if err != nil {
+		t.Fatalf("verifyTOTPCode: %v", err)
+	}
+	if !ok {
+		t.Fatalf("verifyTOTPCode rejected the current window's code")
+	}
+
+	previous, err := hotp(secret, uint64(now.Unix())/totpWindowSeconds-1)
+	if err != nil {
+		t.Fatalf("hotp: %v", err)
+	}
+	ok, err = verifyTOTPCode(secret, previous)
+	if err != nil {
+		t.Fatalf("verifyTOTPCode: %v", err)
+	}
+	if !ok {
+		t.Fatalf("verifyTOTPCode rejected the previous window's code")
+	}
+
+	farFuture, err := hotp(secret, uint64(now.Unix())/totpWindowSeconds+2)
+	if err != nil {
+		t.Fatalf("hotp: %v", err)
+	}
+	ok, err = verifyTOTPCode(secret, farFuture)
+	if err != nil {
+		t.Fatalf("verifyTOTPCode: %v", err)
+	}
+	if ok {
+		t.Fatalf("verifyTOTPCode accepted a code two windows away")
+	}
+}